@@ -18,6 +18,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"santoshsahu/ipcap/pkg/icap"
@@ -29,8 +30,9 @@ func main() {
 	// Set the files to be made available under http://gateway/
 	http.Handle("/", http.FileServer(http.Dir(os.Getenv("HOME")+"/Sites")))
 
-	icap.HandleFunc("/ext_cap/v1/icap/req", toGolang)
-	icap.HandleFunc("/ext_cap/v1/icap/res", toGolang)
+	dumped := icap.WithDump(icap.HandlerFunc(toGolang), os.Stdout)
+	icap.HandleFunc("/ext_cap/v1/icap/req", dumped.ServeICAP)
+	icap.HandleFunc("/ext_cap/v1/icap/res", dumped.ServeICAP)
 	//icap.ListenAndServe(":80", icap.HandlerFunc(toGolang))
 	icap.ListenAndServeSSL(":443","cert.crt", "key.pem", icap.HandlerFunc(toGolang))
 }
@@ -44,8 +46,7 @@ func toGolang(w icap.ResponseWriter, req *icap.Request) {
 		fmt.Println("txid ", req.Header.Get("txid"))
 		fmt.Println("Orig Request URL: ", req.Request.URL)
 		fmt.Println("Orig Request Headers: ", req.Request.Header)
-		buf := make([]byte, req.Request.ContentLength)
-		req.Request.Body.Read(buf)
+		buf, _ := ioutil.ReadAll(req.Request.Body)
 		fmt.Println("Orig Request body: ", string(buf))
 		w.WriteHeader(204, nil, false)
 	case "RESPMOD":
@@ -53,8 +54,7 @@ func toGolang(w icap.ResponseWriter, req *icap.Request) {
 		fmt.Println("txid ", req.Header.Get("txid"))
 		fmt.Println("Orig Response Code: ", req.Response.Status)
 		fmt.Println("Orig Response Headers: ", req.Response.Header)
-		buf := make([]byte, req.Response.ContentLength)
-		req.Response.Body.Read(buf)
+		buf, _ := ioutil.ReadAll(req.Response.Body)
 		fmt.Println("Orig Response body: ", string(buf))
 		w.WriteHeader(204, nil, false)
 
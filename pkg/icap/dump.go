@@ -0,0 +1,191 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Wire-format dumping of requests and responses, for debugging.
+
+package icap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// DumpRequest returns the on-wire ICAP representation of req: its
+// request line and headers, followed by the encapsulated HTTP
+// request and/or response (status line, headers, and, if withBody is
+// true, the chunk-encoded body). Dumping the body consumes req's
+// encapsulated Request.Body and/or Response.Body; DumpRequest replaces
+// them with an equivalent reader first, so the handler can still read
+// them afterward.
+func DumpRequest(req *Request, withBody bool) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s ICAP/1.0\r\n", req.Method, req.URL)
+	writeHeader(&b, http.Header(req.Header))
+	b.WriteString("\r\n")
+
+	if req.Request != nil {
+		writeHTTPMessage(&b, req.Request)
+		// In RESPMOD the body belongs to the response, not the request.
+		if withBody && req.Request.Body != nil && req.Response == nil {
+			data, repl, err := drainAndReplace(req.Request.Body)
+			if err != nil {
+				return nil, err
+			}
+			req.Request.Body = repl
+			writeChunkedBody(&b, data)
+		}
+	}
+
+	if req.Response != nil {
+		writeHTTPMessage(&b, req.Response)
+		if withBody && req.Response.Body != nil {
+			data, repl, err := drainAndReplace(req.Response.Body)
+			if err != nil {
+				return nil, err
+			}
+			req.Response.Body = repl
+			writeChunkedBody(&b, data)
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+// DumpResponse returns the on-wire ICAP representation of a response a
+// handler is about to send: its status line, header, and the
+// encapsulated HTTP message, if any. It takes the same (code,
+// httpMessage, hasBody) triple a Handler passes to
+// ResponseWriter.WriteHeader rather than a dedicated response type,
+// since this package is server-only and has no ICAP client response to
+// dump. If withBody is true, body is read in full and appended as a
+// chunk-encoded encapsulated body.
+func DumpResponse(code int, header http.Header, httpMessage interface{}, body io.Reader, withBody bool) ([]byte, error) {
+	var b bytes.Buffer
+	status := StatusText(code)
+	if status == "" {
+		status = fmt.Sprintf("status code %d", code)
+	}
+	fmt.Fprintf(&b, "ICAP/1.0 %d %s\r\n", code, status)
+	writeHeader(&b, header)
+	b.WriteString("\r\n")
+
+	writeHTTPMessage(&b, httpMessage)
+
+	if withBody && body != nil {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		writeChunkedBody(&b, data)
+	}
+
+	return b.Bytes(), nil
+}
+
+// writeHTTPMessage writes the status/request line and headers of the
+// encapsulated HTTP request or response that accompanies an ICAP
+// message. httpMessage is nil for a null-body ICAP message (e.g. a
+// 204), an *http.Request for REQMOD, or an *http.Response for RESPMOD,
+// matching ResponseWriter.WriteHeader's second argument.
+func writeHTTPMessage(b *bytes.Buffer, httpMessage interface{}) {
+	switch m := httpMessage.(type) {
+	case *http.Request:
+		fmt.Fprintf(b, "%s %s HTTP/1.1\r\n", m.Method, m.URL.RequestURI())
+		writeHeader(b, m.Header)
+		b.WriteString("\r\n")
+	case *http.Response:
+		fmt.Fprintf(b, "HTTP/1.1 %s\r\n", m.Status)
+		writeHeader(b, m.Header)
+		b.WriteString("\r\n")
+	}
+}
+
+// drainAndReplace reads body in full (correctly handling short reads,
+// unlike a single bare Read call) and returns the bytes read along
+// with a fresh reader over them, so the original can be replaced and
+// read again later.
+func drainAndReplace(body io.ReadCloser) (data []byte, replacement io.ReadCloser, err error) {
+	data, err = ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// writeChunkedBody appends data to b using the same chunked-encoding
+// framing (a hex size line per chunk, a zero-length chunk to finish)
+// the server uses on the wire, ending with the "ieof" marker that
+// signals this is the encapsulated message's final chunk.
+func writeChunkedBody(b *bytes.Buffer, data []byte) {
+	if len(data) > 0 {
+		fmt.Fprintf(b, "%x\r\n", len(data))
+		b.Write(data)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("0; ieof\r\n\r\n")
+}
+
+func writeHeader(b *bytes.Buffer, h http.Header) {
+	for k, vv := range h {
+		for _, v := range vv {
+			fmt.Fprintf(b, "%s: %s\r\n", k, v)
+		}
+	}
+}
+
+// WithDump wraps h so that, once each request has been served, the
+// full ICAP transaction - the request as received and the response h
+// wrote - is dumped to w in wire format. It's meant for diagnosing
+// interop problems with Squid, TrafficServer, or vendor engines that
+// produce subtly non-conformant framing.
+func WithDump(h Handler, w io.Writer) Handler {
+	return HandlerFunc(func(rw ResponseWriter, req *Request) {
+		reqDump, err := DumpRequest(req, true)
+		if err != nil {
+			log.Println("icap: dump request:", err)
+		}
+
+		drw := &dumpResponseWriter{ResponseWriter: rw}
+		h.ServeICAP(drw, req)
+		if drw.hasBody {
+			drw.buf.WriteString("0; ieof\r\n\r\n")
+		}
+
+		if reqDump != nil {
+			w.Write(reqDump)
+		}
+		w.Write(drw.buf.Bytes())
+	})
+}
+
+// A dumpResponseWriter tees everything written through it into buf, in
+// wire format, while still forwarding to the real ResponseWriter.
+type dumpResponseWriter struct {
+	ResponseWriter
+	buf     bytes.Buffer
+	hasBody bool
+}
+
+func (d *dumpResponseWriter) WriteHeader(code int, httpMessage interface{}, hasBody bool) {
+	dump, err := DumpResponse(code, d.Header(), httpMessage, nil, false)
+	if err == nil {
+		d.buf.Write(dump)
+	}
+	d.hasBody = hasBody
+	d.ResponseWriter.WriteHeader(code, httpMessage, hasBody)
+}
+
+func (d *dumpResponseWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		fmt.Fprintf(&d.buf, "%x\r\n", len(p))
+		d.buf.Write(p)
+		d.buf.WriteString("\r\n")
+	}
+	return d.ResponseWriter.Write(p)
+}
@@ -0,0 +1,489 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// An ICAP reverse proxy, for chaining to an upstream ICAP server.
+
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Proxy is a Handler that forwards REQMOD, RESPMOD and OPTIONS
+// requests to an upstream ICAP server and streams its response back
+// to the client, analogous to httputil.ReverseProxy for HTTP. It is
+// useful for building an ICAP load balancer, or for shimming this
+// package in front of a vendor content-adaptation engine.
+//
+// This package is server-only - there is no ICAP client to build on -
+// so Proxy carries its own minimal wire serializer and response
+// parser rather than calling into one.
+type Proxy struct {
+	// Director rewrites the outgoing request, most importantly its
+	// URL, to point at the desired upstream ICAP service. It must
+	// not be nil.
+	Director func(req *Request)
+
+	// ErrorLog specifies an optional logger for errors reaching the
+	// upstream server. If nil, logging is done via the log package's
+	// standard logger.
+	ErrorLog *log.Logger
+
+	mu   sync.Mutex
+	idle map[string][]*upstreamConn // keyed by req.URL.Host
+}
+
+// NewSingleHostProxy returns a Proxy that rewrites every request's URL
+// to target, preserving the original path and query, and sets the
+// Host header to match.
+func NewSingleHostProxy(target *url.URL) *Proxy {
+	return &Proxy{
+		Director: func(req *Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.Header.Set("Host", target.Host)
+		},
+	}
+}
+
+// ServeICAP implements Handler.
+func (p *Proxy) ServeICAP(w ResponseWriter, req *Request) {
+	switch req.Method {
+	case "REQMOD", "RESPMOD", "OPTIONS":
+	default:
+		w.WriteHeader(405, nil, false)
+		return
+	}
+
+	outreq := new(Request)
+	*outreq = *req
+	outreq.Header = cloneHeader(req.Header)
+	if req.URL != nil {
+		u := *req.URL
+		outreq.URL = &u
+	}
+	p.Director(outreq)
+
+	uc, err := p.dial(outreq.URL.Host)
+	if err != nil {
+		p.logf("icap: proxy dial %s: %v", outreq.URL.Host, err)
+		w.WriteHeader(500, nil, false)
+		return
+	}
+
+	resp, err := uc.RoundTrip(outreq)
+	if err != nil {
+		uc.close()
+		p.logf("icap: proxy round trip to %s: %v", outreq.URL.Host, err)
+		w.WriteHeader(500, nil, false)
+		return
+	}
+
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+
+	// The second argument to WriteHeader is the encapsulated HTTP
+	// message, not the ICAP header map - forward whichever one the
+	// upstream sent back, so its adapted payload (and not the ICAP
+	// envelope) ends up in the Encapsulated section.
+	var httpMessage interface{}
+	switch {
+	case resp.HTTPResponse != nil:
+		httpMessage = resp.HTTPResponse
+	case resp.HTTPRequest != nil:
+		httpMessage = resp.HTTPRequest
+	}
+
+	hasBody := resp.Body != nil
+	w.WriteHeader(resp.StatusCode, httpMessage, hasBody)
+	if hasBody {
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+	}
+
+	p.release(outreq.URL.Host, uc)
+}
+
+func (p *Proxy) logf(format string, args ...interface{}) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// dial returns an idle connection to host if one is pooled, otherwise
+// it opens a new one.
+func (p *Proxy) dial(host string) (*upstreamConn, error) {
+	p.mu.Lock()
+	if pool := p.idle[host]; len(pool) > 0 {
+		uc := pool[len(pool)-1]
+		p.idle[host] = pool[:len(pool)-1]
+		p.mu.Unlock()
+		return uc, nil
+	}
+	p.mu.Unlock()
+
+	rwc, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	return &upstreamConn{
+		host: host,
+		rwc:  rwc,
+		br:   bufio.NewReader(rwc),
+	}, nil
+}
+
+// release returns uc to the pool for its host so a later request can
+// reuse the persistent connection, per the keep-alive support in Server.
+func (p *Proxy) release(host string, uc *upstreamConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.idle == nil {
+		p.idle = make(map[string][]*upstreamConn)
+	}
+	p.idle[host] = append(p.idle[host], uc)
+}
+
+// An upstreamConn is a persistent connection to one upstream ICAP
+// server, shared across requests to that host.
+type upstreamConn struct {
+	host string
+	rwc  net.Conn
+	br   *bufio.Reader
+}
+
+func (uc *upstreamConn) close() {
+	uc.rwc.Close()
+}
+
+// RoundTrip sends req to the upstream server and reads back its
+// response. The caller is responsible for returning uc to the pool
+// (or closing it on error).
+//
+// If req carries a Preview header, only the preview-sized prefix of
+// the body is sent up front, per the inbound client's own preview
+// negotiation; RoundTrip then waits for the upstream's interim 100
+// Continue before streaming the rest, the same two-phase exchange
+// ReadRequest already does on the server side.
+func (uc *upstreamConn) RoundTrip(req *Request) (*upstreamResponse, error) {
+	remainder, wantsContinue, err := writeRequestWire(uc.rwc, req)
+	if err != nil {
+		return nil, err
+	}
+	if !wantsContinue {
+		return readResponseWire(uc.br)
+	}
+
+	resp, err := readResponseWire(uc.br)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 100 {
+		// The upstream answered from the preview alone (e.g. a 204);
+		// there is no more body to send.
+		return resp, nil
+	}
+
+	var chunk bytes.Buffer
+	writeChunkedBody(&chunk, remainder)
+	if _, err := uc.rwc.Write(chunk.Bytes()); err != nil {
+		return nil, err
+	}
+	return readResponseWire(uc.br)
+}
+
+// An upstreamResponse is what RoundTrip reads back from an upstream
+// ICAP server: its ICAP status and headers, plus whichever
+// encapsulated HTTP message (request or response) and body it
+// carried, if any.
+type upstreamResponse struct {
+	StatusCode int
+	Header     http.Header
+
+	HTTPRequest  *http.Request
+	HTTPResponse *http.Response
+	Body         io.ReadCloser
+}
+
+// writeRequestWire serializes req onto w in ICAP wire format,
+// computing the Encapsulated header and chunk-encoding the
+// encapsulated body, if any. If req.Header carries a Preview whose
+// size is smaller than the body, only that many bytes are written,
+// wantsContinue is true, and remainder holds what's left to send once
+// the upstream's 100 Continue arrives.
+func writeRequestWire(w io.Writer, req *Request) (remainder []byte, wantsContinue bool, err error) {
+	var httpBuf bytes.Buffer
+	var body io.ReadCloser
+	var encapsulated []string
+
+	switch {
+	case req.Request != nil && req.Response == nil:
+		fmt.Fprintf(&httpBuf, "%s %s HTTP/1.1\r\n", req.Request.Method, req.Request.URL.RequestURI())
+		writeHeader(&httpBuf, req.Request.Header)
+		httpBuf.WriteString("\r\n")
+		encapsulated = append(encapsulated, "req-hdr=0")
+		if req.Request.Body != nil {
+			encapsulated = append(encapsulated, fmt.Sprintf("req-body=%d", httpBuf.Len()))
+			body = req.Request.Body
+		} else {
+			encapsulated = append(encapsulated, fmt.Sprintf("null-body=%d", httpBuf.Len()))
+		}
+	case req.Response != nil:
+		if req.Request != nil {
+			fmt.Fprintf(&httpBuf, "%s %s HTTP/1.1\r\n", req.Request.Method, req.Request.URL.RequestURI())
+			writeHeader(&httpBuf, req.Request.Header)
+			httpBuf.WriteString("\r\n")
+			encapsulated = append(encapsulated, "req-hdr=0")
+		}
+		encapsulated = append(encapsulated, fmt.Sprintf("res-hdr=%d", httpBuf.Len()))
+		fmt.Fprintf(&httpBuf, "HTTP/1.1 %s\r\n", req.Response.Status)
+		writeHeader(&httpBuf, req.Response.Header)
+		httpBuf.WriteString("\r\n")
+		if req.Response.Body != nil {
+			encapsulated = append(encapsulated, fmt.Sprintf("res-body=%d", httpBuf.Len()))
+			body = req.Response.Body
+		} else {
+			encapsulated = append(encapsulated, fmt.Sprintf("null-body=%d", httpBuf.Len()))
+		}
+	default:
+		encapsulated = append(encapsulated, "null-body=0")
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s ICAP/1.0\r\n", req.Method, req.URL)
+	hdr := cloneHeader(req.Header)
+	hdr.Set("Encapsulated", strings.Join(encapsulated, ", "))
+	writeHeader(&b, http.Header(hdr))
+	b.WriteString("\r\n")
+	b.Write(httpBuf.Bytes())
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return nil, false, err
+	}
+
+	if body == nil {
+		return nil, false, nil
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, false, err
+	}
+
+	previewSize := -1
+	if p := req.Header.Get("Preview"); p != "" {
+		if n, perr := strconv.Atoi(p); perr == nil {
+			previewSize = n
+		}
+	}
+
+	if previewSize >= 0 && previewSize < len(data) {
+		var chunk bytes.Buffer
+		writePreviewChunk(&chunk, data[:previewSize])
+		if _, err := w.Write(chunk.Bytes()); err != nil {
+			return nil, false, err
+		}
+		return data[previewSize:], true, nil
+	}
+
+	var chunk bytes.Buffer
+	writeChunkedBody(&chunk, data)
+	_, err = w.Write(chunk.Bytes())
+	return nil, false, err
+}
+
+// writePreviewChunk writes data as a chunk-encoded ICAP preview body
+// that does not claim to be the end of the message (no "ieof"
+// extension), so the upstream knows to ask for the rest with a 100
+// Continue instead of treating the preview as the whole body.
+func writePreviewChunk(b *bytes.Buffer, data []byte) {
+	if len(data) > 0 {
+		fmt.Fprintf(b, "%x\r\n", len(data))
+		b.Write(data)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("0\r\n\r\n")
+}
+
+// readResponseWire parses an ICAP response - status line, headers,
+// and whichever encapsulated HTTP message and chunked body follow -
+// from br.
+func readResponseWire(br *bufio.Reader) (*upstreamResponse, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("icap: malformed response status line %q", line)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("icap: malformed response status code %q", parts[1])
+	}
+
+	tp := textproto.NewReader(br)
+	mh, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	header := http.Header(mh)
+	resp := &upstreamResponse{StatusCode: code, Header: header}
+
+	enc := header.Get("Encapsulated")
+	var body []byte
+	switch {
+	case strings.Contains(enc, "res-hdr"):
+		statusLine, msgHeader, err := readEncapsulatedHeader(tp)
+		if err != nil {
+			return nil, err
+		}
+		resp.HTTPResponse = &http.Response{Header: msgHeader, Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1}
+		fillHTTPStatus(resp.HTTPResponse, statusLine)
+		if strings.Contains(enc, "res-body") {
+			if body, err = readChunkedBody(br); err != nil {
+				return nil, err
+			}
+		}
+	case strings.Contains(enc, "req-hdr"):
+		requestLine, msgHeader, err := readEncapsulatedHeader(tp)
+		if err != nil {
+			return nil, err
+		}
+		if resp.HTTPRequest, err = buildHTTPRequest(requestLine, msgHeader); err != nil {
+			return nil, err
+		}
+		if strings.Contains(enc, "req-body") {
+			if body, err = readChunkedBody(br); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if body != nil {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if resp.HTTPResponse != nil {
+			resp.HTTPResponse.Body = resp.Body
+		}
+		if resp.HTTPRequest != nil {
+			resp.HTTPRequest.Body = resp.Body
+		}
+	}
+
+	return resp, nil
+}
+
+// readEncapsulatedHeader reads the status/request line and MIME
+// headers of an encapsulated HTTP message.
+func readEncapsulatedHeader(tp *textproto.Reader) (firstLine string, header http.Header, err error) {
+	firstLine, err = tp.ReadLine()
+	if err != nil {
+		return "", nil, err
+	}
+	mh, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	return firstLine, http.Header(mh), nil
+}
+
+func fillHTTPStatus(resp *http.Response, statusLine string) {
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) >= 2 {
+		resp.StatusCode, _ = strconv.Atoi(parts[1])
+	}
+	if len(parts) == 3 {
+		resp.Status = parts[1] + " " + parts[2]
+	}
+}
+
+func buildHTTPRequest(requestLine string, header http.Header) (*http.Request, error) {
+	parts := strings.SplitN(requestLine, " ", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("icap: malformed encapsulated request line %q", requestLine)
+	}
+	u, err := url.ParseRequestURI(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &http.Request{
+		Method:     parts[0],
+		URL:        u,
+		Header:     header,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}, nil
+}
+
+// readChunkedBody reads a chunk-encoded ICAP body (the same framing
+// respWriter writes on the server side) up to and including its
+// terminating zero-length chunk, and returns the reassembled bytes.
+func readChunkedBody(br *bufio.Reader) ([]byte, error) {
+	var out bytes.Buffer
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeField := strings.TrimRight(line, "\r\n")
+		if i := strings.IndexByte(sizeField, ';'); i >= 0 {
+			sizeField = sizeField[:i]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("icap: malformed chunk size %q", sizeField)
+		}
+		if size == 0 {
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					return nil, err
+				}
+				if line == "\r\n" || line == "\n" {
+					return out.Bytes(), nil
+				}
+			}
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		out.Write(chunk)
+		if _, err := br.Discard(2); err != nil { // the chunk's trailing CRLF
+			return nil, err
+		}
+	}
+}
+
+// cloneHeader copies an ICAP header (Request.Header is
+// textproto.MIMEHeader, not http.Header - that's the encapsulated
+// HTTP message's header type) so Director can rewrite outreq's
+// headers without mutating the original inbound request.
+func cloneHeader(h textproto.MIMEHeader) textproto.MIMEHeader {
+	h2 := make(textproto.MIMEHeader, len(h))
+	for k, vv := range h {
+		vv2 := make([]string, len(vv))
+		copy(vv2, vv)
+		h2[k] = vv2
+	}
+	return h2
+}
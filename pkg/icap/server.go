@@ -9,14 +9,55 @@ package icap
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// icapALPNProto is the ALPN token ICAP-over-TLS (ICAPS) connections
+// negotiate. acmeALPNProto is the token used by the ACME TLS-ALPN-01
+// challenge (RFC 8737), the only practical way to prove domain
+// ownership on the non-443 ports ICAP normally runs on.
+const (
+	icapALPNProto = "icap/1.0"
+	acmeALPNProto = "acme-tls/1"
+)
+
+// errTooManyHeaderBytes is returned by connReader when a request's
+// ICAP and encapsulated headers exceed Server.MaxHeaderBytes.
+var errTooManyHeaderBytes = errors.New("icap: request headers too large")
+
+// defaultMaxHeaderBytes is used when Server.MaxHeaderBytes is zero.
+const defaultMaxHeaderBytes = 1 << 20 // 1 MB
+
+// ErrServerClosed is returned by Server.Serve and Server.ListenAndServe*
+// methods after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("icap: Server closed")
+
+// shutdownPollInterval is how often Shutdown polls for idle
+// connections while waiting for active ones to finish.
+const shutdownPollInterval = 500 * time.Millisecond
+
+// connState records whether a conn is between requests (idle) or in
+// the middle of reading/handling one (active), so that Shutdown knows
+// which connections are safe to close immediately.
+type connState int32
+
+const (
+	stateIdle connState = iota
+	stateActive
 )
 
 // Objects implementing the Handler interface can be registered
@@ -39,21 +80,65 @@ func (f HandlerFunc) ServeICAP(w ResponseWriter, r *Request) {
 	f(w, r)
 }
 
+// A connReader sits between a conn's bufio.Reader and the raw
+// net.Conn so the server can cap the number of bytes spent reading
+// an ICAP request's headers via Server.MaxHeaderBytes, independent
+// of any read deadline.
+type connReader struct {
+	conn   *conn
+	remain int64 // bytes left before hitting the header limit; <0 means unlimited
+}
+
+func (cr *connReader) Read(p []byte) (n int, err error) {
+	if cr.remain == 0 {
+		return 0, errTooManyHeaderBytes
+	}
+	if cr.remain > 0 && int64(len(p)) > cr.remain {
+		p = p[:cr.remain]
+	}
+	n, err = cr.conn.rwc.Read(p)
+	if cr.remain > 0 {
+		cr.remain -= int64(n)
+	}
+	return n, err
+}
+
+// startHeader resets the reader's budget to the server's
+// MaxHeaderBytes ahead of reading the next request.
+func (cr *connReader) startHeader() {
+	max := int64(defaultMaxHeaderBytes)
+	if cr.conn.server != nil && cr.conn.server.MaxHeaderBytes != 0 {
+		max = int64(cr.conn.server.MaxHeaderBytes)
+	}
+	cr.remain = max
+}
+
+// finishHeader lifts the limit once the headers have been parsed, so
+// it never constrains reads of the encapsulated body.
+func (cr *connReader) finishHeader() {
+	cr.remain = -1
+}
+
 // A conn represents the server side of an ICAP connection.
 type conn struct {
 	remoteAddr string            // network address of remote side
 	handler    Handler           // request handler
 	rwc        net.Conn          // i/o connection
 	buf        *bufio.ReadWriter // buffered rwc
+	r          *connReader       // header-limiting reader underlying buf
+	server     *Server           // the Server that accepted this connection
+	cur        *respWriter       // the request/response currently being handled, if any
 }
 
 // Create new connection from rwc.
-func newConn(rwc net.Conn, handler Handler) (c *conn, err error) {
+func newConn(rwc net.Conn, handler Handler, srv *Server) (c *conn, err error) {
 	c = new(conn)
 	c.remoteAddr = rwc.RemoteAddr().String()
 	c.handler = handler
 	c.rwc = rwc
-	br := bufio.NewReader(rwc)
+	c.server = srv
+	c.r = &connReader{conn: c, remain: -1}
+	br := bufio.NewReader(c.r)
 	bw := bufio.NewWriter(rwc)
 	c.buf = bufio.NewReadWriter(br, bw)
 
@@ -62,10 +147,22 @@ func newConn(rwc net.Conn, handler Handler) (c *conn, err error) {
 
 // Read next request from connection.
 func (c *conn) readRequest() (w *respWriter, err error) {
+	c.r.startHeader()
+	if d := c.server.readHeaderTimeout(); d != 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(d))
+	}
+
 	var req *Request
 	if req, err = ReadRequest(c.buf); err != nil {
 		return nil, err
 	}
+	c.r.finishHeader()
+
+	if c.server.ReadTimeout != 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(c.server.ReadTimeout))
+	} else {
+		c.rwc.SetReadDeadline(time.Time{})
+	}
 
 	req.RemoteAddr = c.remoteAddr
 
@@ -76,8 +173,25 @@ func (c *conn) readRequest() (w *respWriter, err error) {
 	return w, nil
 }
 
+// wantsClose reports whether the connection should be closed after
+// this request/response pair instead of being kept alive for the
+// next one: either side, client or handler, may ask for that via a
+// Connection: close header.
+func (w *respWriter) wantsClose() bool {
+	if w.req.Header.Get("Connection") == "close" {
+		return true
+	}
+	if w.header.Get("Connection") == "close" {
+		return true
+	}
+	return false
+}
+
 // Close the connection.
 func (c *conn) close() {
+	if c.server != nil {
+		c.server.trackConn(c, false)
+	}
 	if c.buf != nil {
 		c.buf.Flush()
 		c.buf = nil
@@ -88,35 +202,110 @@ func (c *conn) close() {
 	}
 }
 
-// Serve a new connection.
+// Serve a new connection, keeping it open for further requests
+// (RFC 3507 persistent connections) until the peer asks to close it,
+// a read fails or times out, or the request turns out malformed.
 func (c *conn) serve() {
+	// Deferred LIFO: the recover below must run, and get a chance to
+	// use the still-open connection via PanicHandler, before c.close()
+	// tears it down - so c.close() is deferred first (runs last).
+	defer c.close()
 	defer func() {
-		err := recover()
-		if err == nil {
+		v := recover()
+		if v == nil {
+			return
+		}
+		stack := debug.Stack()
+
+		if c.server.PanicHandler != nil && c.cur != nil {
+			c.runPanicHandler(v, stack)
 			return
 		}
-		c.rwc.Close()
 
 		var buf bytes.Buffer
-		fmt.Fprintf(&buf, "icap: panic serving %v: %v\n", c.remoteAddr, err)
-		buf.Write(debug.Stack())
-		log.Print(buf.String())
+		fmt.Fprintf(&buf, "icap: panic serving %v: %v\n", c.remoteAddr, v)
+		buf.Write(stack)
+		c.server.logf("%s", buf.String())
 	}()
 
-	w, err := c.readRequest()
-	if err != nil {
-		if err != io.ErrUnexpectedEOF {
-			log.Println("error while reading request:", err)
+	if tlsConn, ok := c.rwc.(*tls.Conn); ok {
+		if d := c.server.readHeaderTimeout(); d != 0 {
+			tlsConn.SetReadDeadline(time.Now().Add(d))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			c.server.logf("icap: TLS handshake error from %s: %v", c.remoteAddr, err)
+			return
 		}
+		tlsConn.SetReadDeadline(time.Time{})
+		if tlsConn.ConnectionState().NegotiatedProtocol == acmeALPNProto {
+			// This connection was only opened to complete an ACME
+			// TLS-ALPN-01 challenge; the handshake itself served the
+			// challenge certificate, so there's no ICAP request to read.
+			return
+		}
+	}
 
-		c.rwc.Close()
-		return
+	for {
+		c.server.setConnState(c, stateIdle)
+
+		if d := c.server.idleTimeout(); d != 0 {
+			c.rwc.SetReadDeadline(time.Now().Add(d))
+		}
+		// Wait for the next request under the idle deadline, so that
+		// readRequest's header deadline only starts once it arrives.
+		if _, err := c.buf.Peek(1); err != nil {
+			return
+		}
+
+		w, err := c.readRequest()
+		if err != nil {
+			if err != io.ErrUnexpectedEOF && err != io.EOF {
+				c.server.logf("icap: error while reading request: %v", err)
+			}
+			return
+		}
+		c.server.setConnState(c, stateActive)
+
+		if c.server.WriteTimeout != 0 {
+			c.rwc.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
+		}
+
+		c.cur = w
+		c.handler.ServeICAP(w, w.req)
+		c.cur = nil
+		w.finishRequest()
+		drainUnreadBody(w.req)
+
+		if w.wantsClose() {
+			return
+		}
 	}
+}
 
-	c.handler.ServeICAP(w, w.req)
-	w.finishRequest()
+// drainUnreadBody reads and discards whatever a handler left unread
+// in req's encapsulated HTTP body, if any, so a kept-alive connection
+// stays correctly framed for the next request instead of starting
+// mid-body.
+func drainUnreadBody(req *Request) {
+	if req.Request != nil && req.Request.Body != nil {
+		io.Copy(ioutil.Discard, req.Request.Body)
+	}
+	if req.Response != nil && req.Response.Body != nil {
+		io.Copy(ioutil.Discard, req.Response.Body)
+	}
+}
 
-	c.close()
+// runPanicHandler calls c.server.PanicHandler for the request/response
+// currently in flight, guarding against a PanicHandler that panics
+// itself so the original panic's stack trace is still the one that
+// (if anything) propagates.
+func (c *conn) runPanicHandler(v interface{}, stack []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.server.logf("icap: panic in PanicHandler serving %v: %v", c.remoteAddr, r)
+		}
+	}()
+	c.server.PanicHandler(c.cur, c.cur.req, v, stack)
 }
 
 // A Server defines parameters for running an ICAP server.
@@ -125,6 +314,214 @@ type Server struct {
 	Handler      Handler // handler to invoke
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+
+	// IdleTimeout is the maximum amount of time to wait for the next
+	// request on a keep-alive connection. If zero, ReadTimeout is
+	// used instead. If both are zero, idle connections never time out.
+	IdleTimeout time.Duration
+
+	// ReadHeaderTimeout is the amount of time allowed to read a
+	// request's ICAP and encapsulated headers. The read deadline is
+	// reset after the headers are parsed, so ReadTimeout governs the
+	// encapsulated body that follows.
+	ReadHeaderTimeout time.Duration
+
+	// MaxHeaderBytes controls the maximum number of bytes the server
+	// will read while parsing the ICAP and encapsulated headers of a
+	// request. It does not limit the size of the encapsulated body.
+	// If zero, a default of 1 MB is used.
+	MaxHeaderBytes int
+
+	// TLSConfig optionally provides a TLS configuration for use by
+	// ServeTLS and ServeAutocert. It is cloned before use, so callers
+	// may keep using it for other listeners.
+	TLSConfig *tls.Config
+
+	// ErrorLog specifies an optional logger for errors accepting
+	// connections, reading requests, and panics recovered while
+	// serving them. If nil, logging goes to the standard logger.
+	ErrorLog *log.Logger
+
+	// PanicHandler, if non-nil, is called instead of the server's
+	// default recovery behavior when a handler panics. It lets
+	// callers write a well-formed ICAP error response (with ISTag)
+	// before the connection is torn down. v is the recovered value
+	// and stack the stack trace captured at the point of the panic.
+	PanicHandler func(w ResponseWriter, r *Request, v interface{}, stack []byte)
+
+	inShutdown int32 // accessed atomically
+
+	mu         sync.Mutex
+	listeners  map[*net.Listener]struct{}
+	activeConn map[*conn]connState
+	onShutdown []func()
+}
+
+// trackListener adds or removes l from the set of listeners the
+// server is accepting on. It returns false if the server is already
+// shutting down, in which case the caller should not start serving.
+func (srv *Server) trackListener(l *net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		if srv.listeners == nil {
+			srv.listeners = make(map[*net.Listener]struct{})
+		}
+		srv.listeners[l] = struct{}{}
+	} else {
+		delete(srv.listeners, l)
+	}
+	return true
+}
+
+// trackConn adds or removes c from the set of connections the server
+// is tracking for Shutdown.
+func (srv *Server) trackConn(c *conn, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if add {
+		if srv.activeConn == nil {
+			srv.activeConn = make(map[*conn]connState)
+		}
+		srv.activeConn[c] = stateIdle
+	} else {
+		delete(srv.activeConn, c)
+	}
+}
+
+// setConnState records whether c is idle or in the middle of serving
+// a request.
+func (srv *Server) setConnState(c *conn, state connState) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, ok := srv.activeConn[c]; ok {
+		srv.activeConn[c] = state
+	}
+}
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+// logf writes to srv.ErrorLog, falling back to the standard logger
+// if it is nil.
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// closeListenersLocked closes every listener the server is tracking.
+// srv.mu must be held.
+func (srv *Server) closeListenersLocked() error {
+	var err error
+	for ln := range srv.listeners {
+		if cerr := (*ln).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeIdleConns closes any tracked connections that are currently
+// idle and reports whether every tracked connection was idle (and so
+// has now been closed).
+func (srv *Server) closeIdleConns() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	quiescent := true
+	for c, st := range srv.activeConn {
+		if st != stateIdle {
+			quiescent = false
+			continue
+		}
+		c.rwc.Close()
+		delete(srv.activeConn, c)
+	}
+	return quiescent
+}
+
+// RegisterOnShutdown registers a function to call on Shutdown. This
+// can be used to gracefully shut down connections that remain open
+// between requests. A Proxy's pooled upstream connections are not
+// closed by Shutdown, and Proxy has no method to close them.
+func (srv *Server) RegisterOnShutdown(f func()) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.onShutdown = append(srv.onShutdown, f)
+}
+
+// Shutdown gracefully shuts down the server without interrupting any
+// active connections. Shutdown works by closing all open listeners,
+// then waiting for connections to become idle and closing them. If
+// the provided context expires before the shutdown is complete,
+// Shutdown returns the context's error; otherwise it returns any
+// error returned from closing the server's underlying listeners.
+//
+// Once Shutdown has been called on a server, it may not be reused;
+// future calls to Serve or the ListenAndServe family will return
+// ErrServerClosed.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	lnerr := srv.closeListenersLocked()
+	for _, f := range srv.onShutdown {
+		go f()
+	}
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.closeIdleConns() {
+			return lnerr
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all active listeners and any connections
+// in either idle or active state, without waiting for them to finish.
+// For a graceful shutdown, use Shutdown.
+func (srv *Server) Close() error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	err := srv.closeListenersLocked()
+	for c := range srv.activeConn {
+		c.rwc.Close()
+		delete(srv.activeConn, c)
+	}
+	return err
+}
+
+// idleTimeout returns the timeout to use while waiting for the next
+// request on a keep-alive connection.
+func (srv *Server) idleTimeout() time.Duration {
+	if srv.IdleTimeout != 0 {
+		return srv.IdleTimeout
+	}
+	return srv.ReadTimeout
+}
+
+// readHeaderTimeout returns the timeout to use while reading a
+// request's headers.
+func (srv *Server) readHeaderTimeout() time.Duration {
+	if srv.ReadHeaderTimeout != 0 {
+		return srv.ReadHeaderTimeout
+	}
+	return srv.ReadTimeout
 }
 
 // ListenAndServe listens on the TCP network address srv.Addr and then
@@ -150,28 +547,98 @@ func (srv *Server) ListenAndServeSSL(cert, key string) error {
 	if addr == "" {
 		addr = ":1344"
 	}
-	cer, err := tls.LoadX509KeyPair(cert, key)
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
+	return srv.ServeTLS(l, cert, key)
+}
+
+// ServeTLS behaves like Serve, but expects TLS connections on l and
+// terminates them before dispatching requests. Files containing a
+// certificate and matching private key are required unless srv.TLSConfig
+// already has a certificate (either Certificates or GetCertificate set),
+// in which case certFile and keyFile may be empty.
+func (srv *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config := cloneTLSConfig(srv.TLSConfig)
+	if !containsProto(config.NextProtos, icapALPNProto) {
+		config.NextProtos = append(config.NextProtos, icapALPNProto)
+	}
+
+	configHasCert := len(config.Certificates) > 0 || config.GetCertificate != nil
+	if !configHasCert || certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return srv.Serve(tls.NewListener(l, config))
+}
+
+// ServeAutocert behaves like ServeTLS, but obtains and renews its
+// certificate automatically from an ACME CA (e.g. Let's Encrypt) using
+// autocert. Because ICAP conventionally runs on 1344/11344 rather than
+// 443, the HTTP-01 and TLS-SNI challenges are not usable; ServeAutocert
+// wires up the TLS-ALPN-01 challenge instead, which only needs the
+// listening port itself. cacheDir, if non-empty, is used to persist
+// issued certificates between restarts.
+func (srv *Server) ServeAutocert(hostPolicy autocert.HostPolicy, cacheDir string) error {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: hostPolicy,
+	}
+	if cacheDir != "" {
+		m.Cache = autocert.DirCache(cacheDir)
+	}
 
-	config := &tls.Config{Certificates: []tls.Certificate{cer}}
-	ln, err := tls.Listen("tcp", addr, config)
+	config := cloneTLSConfig(srv.TLSConfig)
+	config.GetCertificate = m.GetCertificate
+	if !containsProto(config.NextProtos, acmeALPNProto) {
+		config.NextProtos = append(config.NextProtos, acmeALPNProto)
+	}
+	srv.TLSConfig = config
+
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":1344"
+	}
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
-	defer ln.Close()
+	return srv.ServeTLS(l, "", "")
+}
 
-	return srv.Serve(ln)
+// cloneTLSConfig returns a copy of cfg suitable for mutating, or a
+// fresh zero-value config if cfg is nil.
+func cloneTLSConfig(cfg *tls.Config) *tls.Config {
+	if cfg == nil {
+		return &tls.Config{}
+	}
+	return cfg.Clone()
+}
+
+func containsProto(protos []string, proto string) bool {
+	for _, p := range protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
 }
 
 // Serve accepts incoming connections on the Listener l, creating a
 // new service thread for each.  The service threads read requests and
 // then call srv.Handler to reply to them.
 func (srv *Server) Serve(l net.Listener) error {
+	if !srv.trackListener(&l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(&l, false)
 	defer l.Close()
+
 	handler := srv.Handler
 	if handler == nil {
 		handler = DefaultServeMux
@@ -180,25 +647,22 @@ func (srv *Server) Serve(l net.Listener) error {
 	for {
 		rw, e := l.Accept()
 		if e != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
-				log.Printf("icap: Accept error: %v", e)
+				srv.logf("icap: Accept error: %v", e)
 				continue
 			}
 			return e
 		}
-		if srv.ReadTimeout != 0 {
-			rw.SetReadDeadline(time.Now().Add(srv.ReadTimeout))
-		}
-		if srv.WriteTimeout != 0 {
-			rw.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
-		}
-		c, err := newConn(rw, handler)
+		c, err := newConn(rw, handler, srv)
 		if err != nil {
 			continue
 		}
+		srv.trackConn(c, true)
 		go c.serve()
 	}
-	panic("not reached")
 }
 
 // Serve accepts incoming ICAP connections on the listener l,